@@ -0,0 +1,66 @@
+// Package backends provides pluggable, cost-aware cache backends for
+// httpcache, in addition to the simple Cache implementations that live in
+// the root package. Backends defined here can be handed directly to
+// httpcache.NewHandler since they satisfy httpcache.Cache.
+package backends
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+
+	"github.com/elico/httpcache"
+)
+
+// Cache is the cost-aware extension of httpcache.Cache. StoreWithCost
+// accepts an explicit cost (typically bytes) so that bounded backends such
+// as Memory can make admission and eviction decisions; Store still
+// satisfies httpcache.Cache by deriving the cost automatically via Cost.
+type Cache interface {
+	httpcache.Cache
+
+	// StoreWithCost stores res under every given key, weighted by cost.
+	// Backends without a notion of cost (e.g. an unbounded map) may treat
+	// cost as advisory.
+	StoreWithCost(res *httpcache.Resource, cost int64, keys ...string) error
+}
+
+// Cost estimates the in-memory footprint of a Resource: its body size as
+// given by the Content-Length header plus a rough accounting of header
+// bytes. The body is not counted when Content-Length is absent or invalid.
+// This mirrors the approach used by GoBlog's cache, where eviction is driven
+// by bytes rather than entry count.
+func Cost(res *httpcache.Resource) int64 {
+	var cost int64
+
+	if length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
+		cost += length
+	}
+
+	for name, values := range res.Header() {
+		for _, v := range values {
+			cost += int64(len(name) + len(v) + 2)
+		}
+	}
+
+	return cost
+}
+
+// Metrics tracks backend-wide counters and publishes them under expvar so
+// operators can scrape them alongside the rest of the process's metrics.
+type Metrics struct {
+	Hits      expvar.Int
+	Misses    expvar.Int
+	Evictions expvar.Int
+	Bytes     expvar.Int
+}
+
+// Publish registers m's counters under expvar using the given name prefix,
+// e.g. m.Publish("httpcache_memory") exposes
+// "httpcache_memory_hits", "httpcache_memory_misses", etc.
+func (m *Metrics) Publish(prefix string) {
+	expvar.Publish(fmt.Sprintf("%s_hits", prefix), &m.Hits)
+	expvar.Publish(fmt.Sprintf("%s_misses", prefix), &m.Misses)
+	expvar.Publish(fmt.Sprintf("%s_evictions", prefix), &m.Evictions)
+	expvar.Publish(fmt.Sprintf("%s_bytes", prefix), &m.Bytes)
+}
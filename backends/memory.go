@@ -0,0 +1,108 @@
+package backends
+
+import (
+	"github.com/dgraph-io/ristretto"
+	"github.com/elico/httpcache"
+)
+
+// MemoryConfig configures a Memory backend.
+type MemoryConfig struct {
+	// NumCounters is the number of 4-bit access counters Ristretto keeps
+	// to estimate key frequency. Ristretto recommends 10x the number of
+	// items expected to fit in MaxCost.
+	NumCounters int64
+
+	// MaxCost bounds the total cost (bytes, by default) the cache will
+	// admit before it starts evicting.
+	MaxCost int64
+
+	// BufferItems is the size of the per-Get buffer used by Ristretto's
+	// internal ring buffers. 64 is the documented default.
+	BufferItems int64
+}
+
+// Memory is a Ristretto-backed in-memory Cache with cost-aware admission
+// and eviction, suitable as a hot tier in front of a larger disk-backed
+// Cache (see Tiered).
+type Memory struct {
+	ristretto *ristretto.Cache
+	metrics   Metrics
+}
+
+// NewMemory builds a Memory backend from cfg. Zero-value fields fall back
+// to Ristretto's documented defaults.
+func NewMemory(cfg MemoryConfig) (*Memory, error) {
+	if cfg.NumCounters == 0 {
+		cfg.NumCounters = 1e7
+	}
+	if cfg.MaxCost == 0 {
+		cfg.MaxCost = 1 << 30 // 1GiB
+	}
+	if cfg.BufferItems == 0 {
+		cfg.BufferItems = 64
+	}
+
+	rc, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: cfg.NumCounters,
+		MaxCost:     cfg.MaxCost,
+		BufferItems: cfg.BufferItems,
+		OnEvict:     nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Memory{ristretto: rc}, nil
+}
+
+// Retrieve implements httpcache.Cache.
+func (m *Memory) Retrieve(key string) (*httpcache.Resource, error) {
+	v, ok := m.ristretto.Get(key)
+	if !ok {
+		m.metrics.Misses.Add(1)
+		return nil, httpcache.ErrNotFoundInCache
+	}
+
+	m.metrics.Hits.Add(1)
+	res, ok := v.(*httpcache.Resource)
+	if !ok {
+		return nil, httpcache.ErrNotFoundInCache
+	}
+	return res, nil
+}
+
+// Store implements httpcache.Cache, deriving the cost of res via Cost.
+func (m *Memory) Store(res *httpcache.Resource, keys ...string) error {
+	return m.StoreWithCost(res, Cost(res), keys...)
+}
+
+// StoreWithCost implements Cache, storing res under every key weighted by
+// cost. A key is only admitted if Ristretto's admission policy accepts it;
+// rejected keys are not treated as an error since the resource remains
+// servable from the next cache tier.
+func (m *Memory) StoreWithCost(res *httpcache.Resource, cost int64, keys ...string) error {
+	for _, key := range keys {
+		if m.ristretto.Set(key, res, cost) {
+			m.metrics.Bytes.Add(cost)
+		}
+	}
+	return nil
+}
+
+// Freshen implements httpcache.Cache by re-inserting res, refreshing its
+// position in Ristretto's policy.
+func (m *Memory) Freshen(res *httpcache.Resource, keys ...string) error {
+	return m.Store(res, keys...)
+}
+
+// Del removes key from the cache, used by Tiered when demoting cold entries.
+func (m *Memory) Del(key string) {
+	m.ristretto.Del(key)
+}
+
+// Metrics returns m's counters. Memory updates Hits, Misses and Bytes;
+// it does not update Evictions, and Bytes grows by the cost of each Set
+// that Ristretto accepts without being reduced on eviction or Del.
+func (m *Memory) Metrics() *Metrics {
+	return &m.metrics
+}
@@ -0,0 +1,61 @@
+package backends
+
+import (
+	"github.com/elico/httpcache"
+)
+
+// Tiered composes a small, fast Memory tier in front of a larger, slower
+// disk-backed httpcache.Cache. Reads promote hot entries into memory on
+// every hit; writes always land on disk and are opportunistically mirrored
+// into memory so that Handler.lookup/storeResource transparently benefit
+// from a bounded RAM working set.
+type Tiered struct {
+	hot  *Memory
+	cold httpcache.Cache
+}
+
+// NewTiered returns a Tiered backend using hot as the in-memory tier and
+// cold as the disk (or otherwise larger) tier.
+func NewTiered(hot *Memory, cold httpcache.Cache) *Tiered {
+	return &Tiered{hot: hot, cold: cold}
+}
+
+// Retrieve implements httpcache.Cache, checking the hot tier first and
+// promoting on a cold hit.
+func (t *Tiered) Retrieve(key string) (*httpcache.Resource, error) {
+	if res, err := t.hot.Retrieve(key); err == nil {
+		return res, nil
+	}
+
+	res, err := t.cold.Retrieve(key)
+	if err != nil {
+		return res, err
+	}
+
+	t.hot.Store(res, key)
+	return res, nil
+}
+
+// Store implements httpcache.Cache, deriving cost via Cost.
+func (t *Tiered) Store(res *httpcache.Resource, keys ...string) error {
+	return t.StoreWithCost(res, Cost(res), keys...)
+}
+
+// StoreWithCost implements Cache. The cold tier is always written since it
+// has no meaningful capacity bound; the hot tier is written on a
+// best-effort basis and may reject or evict the entry under pressure.
+func (t *Tiered) StoreWithCost(res *httpcache.Resource, cost int64, keys ...string) error {
+	if err := t.cold.Store(res, keys...); err != nil {
+		return err
+	}
+	return t.hot.StoreWithCost(res, cost, keys...)
+}
+
+// Freshen implements httpcache.Cache, demoting the entry out of the hot
+// tier so the next read re-promotes it with the freshened headers.
+func (t *Tiered) Freshen(res *httpcache.Resource, keys ...string) error {
+	for _, key := range keys {
+		t.hot.Del(key)
+	}
+	return t.cold.Freshen(res, keys...)
+}
@@ -5,13 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/elico/httpcache/rfc"
 )
 
 const (
@@ -21,33 +25,29 @@ const (
 
 var Writes sync.WaitGroup
 
-var storeable = map[int]bool{
-	http.StatusOK:                   true,
-	http.StatusFound:                true,
-	http.StatusNonAuthoritativeInfo: true,
-	http.StatusMultipleChoices:      true,
-	http.StatusMovedPermanently:     true,
-	http.StatusGone:                 true,
-	http.StatusNotFound:             true,
-}
-
-var cacheableByDefault = map[int]bool{
-	http.StatusOK:                   true,
-	http.StatusFound:                true,
-	http.StatusNotModified:          true,
-	http.StatusNonAuthoritativeInfo: true,
-	http.StatusMultipleChoices:      true,
-	http.StatusMovedPermanently:     true,
-	http.StatusGone:                 true,
-	http.StatusPartialContent:       true,
-}
-
 type Handler struct {
 	Shared    bool
 	upstream  http.Handler
 	validator *Validator
 	cache     Cache
 	storeIdUrl *url.URL
+
+	// upstreamGroup coalesces concurrent cache misses for the same Key so
+	// that only one upstream fetch happens at a time; see passUpstream.
+	upstreamGroup singleflight.Group
+
+	// revalidateGroup coalesces concurrent background stale-while-revalidate
+	// refreshes for the same Key, so a popular stale resource doesn't spawn
+	// one upstream fetch per request that lands in its revalidation window;
+	// see revalidateAsync. Kept separate from upstreamGroup since the two
+	// represent different kinds of work (serving a response vs. a
+	// fire-and-forget refresh) even when they'd otherwise share a key.
+	revalidateGroup singleflight.Group
+
+	// rangeCache stores and serves byte-range segments for large binaries;
+	// nil unless enabled via SetRangeCache; while it is nil, Range requests
+	// fall back to the normal whole-resource cache behaviour.
+	rangeCache *RangeCache
 }
 
 func NewHandler(cache Cache, upstream http.Handler, storeIdUrl string) *Handler {
@@ -83,7 +83,7 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 //	debugf("Request headers details after a while2", r.Header)
 
-	res, err := h.lookup(cReq)
+	res, err := h.lookupResource(cReq)
 	switch {
 	case  err != nil && err == ErrNotFoundInCache:
 		;;
@@ -124,13 +124,31 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if !res.MustValidate(h.Shared) {
+			if window, ok := h.staleWhileRevalidateWindow(res, cReq); ok {
+				if stale := h.staleness(res, cReq); stale > 0 && stale <= window {
+					debugf("serving stale response within stale-while-revalidate window of %s", window)
+					res.Header().Set(CacheHeader, "STALE")
+					res.Header().Add("Warning", `110 - "Response is Stale"`)
+					h.serveResource(res, rw, cReq)
+					h.revalidateAsync(cReq)
+
+					if err := res.Close(); err != nil {
+						errorf("Error closing resource: %s", err.Error())
+					}
+					return
+				}
+			}
+		}
+
 		debugf("validating cached response")
-		if h.validator.Validate(r, res) {
+		t := Clock()
+		if valid, replacement := h.validator.Validate(r, res); valid {
 			debugf("response is valid")
 			h.cache.Freshen(res, cReq.Key.String())
 		} else {
 			debugf("response is changed")
-			h.passUpstream(rw, cReq)
+			h.serveValidatedReplacement(rw, cReq, res, replacement, t)
 			return
 		}
 	}
@@ -144,79 +162,52 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// freshness returns the duration that a requested resource will be fresh for
+// freshness returns the duration that a requested resource will be fresh for.
+// The RFC 7234 arithmetic itself lives in rfc.Freshness; this just gathers
+// the inputs from the Resource and cacheRequest.
 func (h *Handler) freshness(res *Resource, r *cacheRequest) (time.Duration, error) {
 	maxAge, err := res.MaxAge(h.Shared)
 	if err != nil {
 		return time.Duration(0), err
 	}
 
-	if r.CacheControl.Has("max-age") {
-		reqMaxAge, err := r.CacheControl.Duration("max-age")
-		if err != nil {
-			return time.Duration(0), err
-		}
-
-		if reqMaxAge < maxAge {
-			debugf("using request max-age of %s", reqMaxAge.String())
-			maxAge = reqMaxAge
-		}
-	}
-
 	age, err := res.Age()
 	if err != nil {
 		return time.Duration(0), err
 	}
 
-	if res.IsStale() {
-		return time.Duration(0), nil
-	}
-
-	if hFresh := res.HeuristicFreshness(); hFresh > maxAge {
-		debugf("using heuristic freshness of %q", hFresh)
-		maxAge = hFresh
-	}
-
-	return maxAge - age, nil
+	return rfc.Freshness(rfc.FreshnessInput{
+		MaxAge:              maxAge,
+		Age:                 age,
+		IsStale:             res.IsStale(),
+		HeuristicFreshness:  res.HeuristicFreshness(),
+		RequestCacheControl: rfc.CacheControl(r.CacheControl),
+	})
 }
 
+// needsValidation fails closed: any error computing freshness, including a
+// malformed request max-age/min-fresh/max-stale directive, is treated as
+// "validation required" rather than silently ignored.
 func (h *Handler) needsValidation(res *Resource, r *cacheRequest) bool {
-	if res.MustValidate(h.Shared) {
-		return true
-	}
-
 	freshness, err := h.freshness(res, r)
 	if err != nil {
 		debugf("error calculating freshness: %s", err.Error())
 		return true
 	}
 
-	if r.CacheControl.Has("min-fresh") {
-		reqMinFresh, err := r.CacheControl.Duration("min-fresh")
-		if err != nil {
-			debugf("error parsing request min-fresh: %s", err.Error())
-			return true
-		}
-
-		if freshness < reqMinFresh {
-			debugf("resource is fresh, but won't satisfy min-fresh of %s", reqMinFresh)
-			return true
-		}
-	}
-
 	debugf("resource has a freshness of %s", freshness)
 
-	if freshness <= 0 && r.CacheControl.Has("max-stale") {
-		if len(r.CacheControl["max-stale"]) == 0 {
-			debugf("resource is stale, but client sent max-stale")
-			return false
-		} else if maxStale, _ := r.CacheControl.Duration("max-stale"); maxStale >= (freshness * -1) {
-			log.Printf("resource is stale, but within allowed max-stale period of %s", maxStale)
-			return false
-		}
+	needsValidation, err := rfc.NeedsValidation(rfc.NeedsValidationInput{
+		MustValidate:        res.MustValidate(h.Shared),
+		Freshness:           freshness,
+		RequestCacheControl: rfc.CacheControl(r.CacheControl),
+	})
+	if err != nil {
+		debugf("error determining whether validation is needed: %s", err.Error())
+		return true
 	}
 
-	return freshness <= 0
+	return needsValidation
 }
 
 // pipeUpstream makes the request via the upstream handler, the response is not stored or modified
@@ -238,8 +229,149 @@ func (h *Handler) pipeUpstream(w http.ResponseWriter, r *cacheRequest) {
 	}
 }
 
-// passUpstream makes the request via the upstream handler and stores the result
+// upstreamCoalesceKey returns the key used to coalesce concurrent upstream
+// fetches for r. The Range header is folded in because r.Key alone doesn't
+// carry it: two requests for the same URL but different byte ranges must
+// never be coalesced onto the same upstream fetch, or whichever one wins
+// the singleflight call ends up serving its bytes and Content-Range to
+// requests asking for a completely different range.
+func upstreamCoalesceKey(r *cacheRequest) string {
+	key := r.Key.String()
+	if rng := r.Header.Get("Range"); rng != "" {
+		key += "::range=" + rng
+	}
+	return key
+}
+
+// passUpstream makes the request via the upstream handler and stores the
+// result. Concurrent misses for the same Key (e.g. many clients requesting
+// the same large download at once) are coalesced via upstreamGroup so that
+// only a single upstream fetch happens.
+//
+// singleflight.Group.Do reports shared=true to *every* caller once two or
+// more overlap, including whichever one actually ran fn - not just the
+// joiners - so fn must never write to a caller-specific http.ResponseWriter
+// directly. Instead fn fetches into a private buffer, and every caller
+// (leader and joiners alike) builds its own independent Resource from the
+// shared buffer and serves that to its own w.
 func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest) {
+	key := upstreamCoalesceKey(r)
+
+	v, _, shared := h.upstreamGroup.Do(key, func() (interface{}, error) {
+		buf := newBufferedResponse()
+		h.fetchUpstream(buf, r)
+		return buf, nil
+	})
+
+	if shared {
+		debugf("request for %s was coalesced onto an in-flight upstream fetch", key)
+	}
+
+	buf := v.(*bufferedResponse)
+	res := NewResourceBytes(buf.statusCode, buf.body.Bytes(), buf.header.Clone())
+	res.Header().Set(CacheHeader, "HIT")
+	h.serveResource(res, w, r)
+
+	if err := res.Close(); err != nil {
+		errorf("Error closing resource: %s", err.Error())
+	}
+}
+
+// serveValidatedReplacement serves replacement, the already-fetched 200 (or
+// error) response Validator.Validate got back for a conditional request
+// that turned out not to be a 304. replacement was already fetched in full,
+// so this applies the same cacheability/Age/store bookkeeping fetchUpstream
+// would after a fresh upstream fetch, instead of making the caller re-fetch
+// upstream a second time just to get the same thing. If replacement is a
+// server error and stale is within its stale-if-error window, stale is
+// served instead per RFC 5861 section 4.
+func (h *Handler) serveValidatedReplacement(w http.ResponseWriter, r *cacheRequest, stale *Resource, replacement *Resource, reqTime time.Time) {
+	if replacement.Status() >= http.StatusInternalServerError {
+		if window, ok := h.staleIfErrorWindow(stale, r); ok {
+			if staleness := h.staleness(stale, r); staleness > 0 && staleness <= window {
+				debugf("validation replacement returned %d, serving stale-if-error copy instead", replacement.Status())
+				stale.Header().Set(CacheHeader, "STALE")
+				stale.Header().Add("Warning", `110 - "Response is Stale"`)
+				h.serveResource(stale, w, r)
+
+				if err := stale.Close(); err != nil {
+					errorf("Error closing resource: %s", err.Error())
+				}
+				if err := replacement.Close(); err != nil {
+					errorf("Error closing resource: %s", err.Error())
+				}
+				return
+			}
+		}
+	}
+
+	if err := stale.Close(); err != nil {
+		errorf("Error closing resource: %s", err.Error())
+	}
+
+	replacement.Header().Set(CacheHeader, "MISS")
+
+	if !h.isCacheable(replacement, r) {
+		debugf("validation replacement is uncacheable")
+		replacement.Header().Set(CacheHeader, "SKIP")
+		h.serveResource(replacement, w, r)
+
+		if err := replacement.Close(); err != nil {
+			errorf("Error closing resource: %s", err.Error())
+		}
+		return
+	}
+
+	if age, err := correctedAge(replacement.Header(), reqTime, Clock()); err == nil {
+		replacement.Header().Set("Age", strconv.Itoa(int(math.Ceil(age.Seconds()))))
+	} else {
+		debugf("error calculating corrected age: %s", err.Error())
+	}
+
+	replacement.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+
+	if replacement.Status() == http.StatusPartialContent {
+		h.storeRangeResource(replacement, r)
+	} else {
+		h.storeResource(replacement, r)
+	}
+
+	h.serveResource(replacement, w, r)
+
+	if err := replacement.Close(); err != nil {
+		errorf("Error closing resource: %s", err.Error())
+	}
+}
+
+// revalidateAsync re-fetches r's upstream resource in the background,
+// discarding the response body; it exists purely to refresh the cache
+// entry used by stale-while-revalidate so the next request is served fresh.
+//
+// Concurrent stale hits within the same revalidation window would otherwise
+// each spawn their own upstream fetch, reintroducing the thundering-herd
+// problem upstreamGroup solves for cache misses - so revalidations for the
+// same key are coalesced through revalidateGroup instead.
+func (h *Handler) revalidateAsync(r *cacheRequest) {
+	key := upstreamCoalesceKey(r)
+
+	Writes.Add(1)
+
+	go func() {
+		defer Writes.Done()
+		h.revalidateGroup.Do(key, func() (interface{}, error) {
+			debugf("asynchronously revalidating %s", key)
+			h.fetchUpstream(newDiscardResponseWriter(), r)
+			return nil, nil
+		})
+	}()
+}
+
+// fetchUpstream performs the actual upstream request and stores the result
+// in the cache if it is cacheable. It writes the response to w as it goes,
+// so it must only ever be called on behalf of the request that owns w (or
+// a buffer/discard writer standing in for one). It returns the fetched
+// Resource regardless of cacheability so callers can inspect its status.
+func (h *Handler) fetchUpstream(w http.ResponseWriter, r *cacheRequest) *Resource {
 	rw := newResponseBuffer(w)
 
 	t := Clock()
@@ -252,7 +384,7 @@ func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest) {
 	if !h.isCacheable(res, r) {
 		debugf("resource is uncacheable")
 		rw.Header().Set(CacheHeader, "SKIP")
-		return
+		return res
 	}
 
 	if age, err := correctedAge(res.Header(), t, Clock()); err == nil {
@@ -262,80 +394,132 @@ func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest) {
 	}
 
 	rw.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
-	h.storeResource(res, r)
-}
-
-// correctedAge adjusts the age of a resource for clock skeq and travel time
-// https://httpwg.github.io/specs/rfc7234.html#rfc.section.4.2.3
-func correctedAge(h http.Header, reqTime, respTime time.Time) (time.Duration, error) {
-	date, err := timeHeader("Date", h)
-	if err != nil {
-		return time.Duration(0), err
-	}
 
-	apparentAge := respTime.Sub(date)
-	if apparentAge < 0 {
-		apparentAge = 0
+	if res.Status() == http.StatusPartialContent {
+		h.storeRangeResource(res, r)
+	} else {
+		h.storeResource(res, r)
 	}
 
-	respDelay := respTime.Sub(reqTime)
-	ageSeconds, err := intHeader("Age", h)
-	age := time.Second * time.Duration(ageSeconds)
-	correctedAge := age + respDelay
+	return res
+}
 
-	if apparentAge > correctedAge {
-		correctedAge = apparentAge
+// staleness reports how far past its freshness lifetime res currently is,
+// or zero if it is still fresh. It is the mirror image of freshness.
+func (h *Handler) staleness(res *Resource, r *cacheRequest) time.Duration {
+	freshness, err := h.freshness(res, r)
+	if err != nil || freshness > 0 {
+		return 0
 	}
+	return -freshness
+}
 
-	residentTime := Clock().Sub(respTime)
-	currentAge := correctedAge + residentTime
+// staleWhileRevalidateWindow returns the stale-while-revalidate duration
+// from res's or r's Cache-Control, per RFC 5861 section 3.
+func (h *Handler) staleWhileRevalidateWindow(res *Resource, r *cacheRequest) (time.Duration, bool) {
+	return staleDirectiveWindow(res, r, "stale-while-revalidate")
+}
 
-	return currentAge, nil
+// staleIfErrorWindow returns the stale-if-error duration from res's or r's
+// Cache-Control, per RFC 5861 section 4.
+func (h *Handler) staleIfErrorWindow(res *Resource, r *cacheRequest) (time.Duration, bool) {
+	return staleDirectiveWindow(res, r, "stale-if-error")
 }
 
-func (h *Handler) isCacheable(res *Resource, r *cacheRequest) bool {
-	cc, err := res.cacheControl()
-	if err != nil {
-		errorf("Error parsing cache-control: %s", err.Error())
-		return false
+func staleDirectiveWindow(res *Resource, r *cacheRequest, directive string) (time.Duration, bool) {
+	if cc, err := res.cacheControl(); err == nil && cc.Has(directive) {
+		if d, err := cc.Duration(directive); err == nil {
+			return d, true
+		}
 	}
 
-	if cc.Has("no-cache") || cc.Has("no-store") {
-		return false
+	if r.CacheControl.Has(directive) {
+		if d, err := r.CacheControl.Duration(directive); err == nil {
+			return d, true
+		}
 	}
 
-	if cc.Has("private") && len(cc["private"]) == 0 && h.Shared {
-		return false
-	}
+	return 0, false
+}
 
-	if _, ok := storeable[res.Status()]; !ok {
-		return false
-	}
+// bufferedResponse is an http.ResponseWriter that never writes through to
+// a real connection; passUpstream fetches into one so that a single
+// upstream response can be served independently to every coalesced caller.
+type bufferedResponse struct {
+	header     http.Header
+	body       bytes.Buffer
+	statusCode int
+}
 
-	if r.Header.Get("Authorization") != "" && h.Shared {
-		return false
-	}
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
 
-	if res.Header().Get("Authorization") != "" && h.Shared &&
-		!cc.Has("must-revalidate") && !cc.Has("s-maxage") {
-		return false
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) { b.statusCode = status }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
 	}
+	return b.body.Write(p)
+}
 
-	if res.HasExplicitExpiration() {
-		return true
+// flushTo writes the buffered header, status and body to w.
+func (b *bufferedResponse) flushTo(w http.ResponseWriter) {
+	for key, headers := range b.header {
+		for _, header := range headers {
+			w.Header().Add(key, header)
+		}
 	}
 
-	if _, ok := cacheableByDefault[res.Status()]; !ok && !cc.Has("public") {
-		return false
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
 	}
+	w.WriteHeader(b.statusCode)
+	w.Write(b.body.Bytes())
+}
 
-	if res.HasValidators() {
-		return true
-	} else if res.HeuristicFreshness() > 0 {
-		return true
+// discardResponseWriter is an http.ResponseWriter that drops everything
+// written to it, used by revalidateAsync where nothing is listening.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: make(http.Header)}
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) WriteHeader(int)             {}
+func (d *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// correctedAge adjusts the age of a resource for clock skeq and travel time
+// https://httpwg.github.io/specs/rfc7234.html#rfc.section.4.2.3
+// correctedAge adjusts the age of a resource for clock skew and travel time.
+// https://httpwg.github.io/specs/rfc7234.html#rfc.section.4.2.3
+func correctedAge(h http.Header, reqTime, respTime time.Time) (time.Duration, error) {
+	return rfc.CorrectedAge(h, reqTime, respTime, Clock())
+}
+
+func (h *Handler) isCacheable(res *Resource, r *cacheRequest) bool {
+	cc, err := res.cacheControl()
+	if err != nil {
+		errorf("Error parsing cache-control: %s", err.Error())
+		return false
 	}
 
-	return false
+	return rfc.IsCacheable(rfc.IsCacheableInput{
+		Status:                res.Status(),
+		ResponseCacheControl:  rfc.CacheControl(cc),
+		RequestHasAuth:        r.Header.Get("Authorization") != "",
+		ResponseHasAuth:       res.Header().Get("Authorization") != "",
+		Shared:                h.Shared,
+		HasExplicitExpiration: res.HasExplicitExpiration(),
+		HasValidators:         res.HasValidators(),
+		HeuristicFreshness:    res.HeuristicFreshness(),
+	})
 }
 
 func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cacheRequest) {
@@ -345,6 +529,16 @@ func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cache
 		}
 	}
 
+	// RFC 7232 section 4.1: if the client's own conditional headers match
+	// this resource's validators, answer 304 directly without writing the
+	// body, even though the validation that got us here (if any) was
+	// between this cache and the upstream, not the client.
+	if requestMatchesValidators(req.Request, res) {
+		debugf("client conditional request matches cached validators, serving 304")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	age, err := res.Age()
 	if err != nil {
 		http.Error(w, "Error calculating age: "+err.Error(),
@@ -378,6 +572,52 @@ func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cache
 	}
 }
 
+// requestMatchesValidators reports whether r carries an If-None-Match or
+// If-Modified-Since header that matches res's own ETag/Last-Modified, per
+// RFC 7232 section 4.1. If-None-Match takes precedence when both are sent.
+func requestMatchesValidators(r *http.Request, res *Resource) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := res.Header().Get("ETag")
+		return etag != "" && etagMatches(inm, etag)
+	}
+
+	lastModified := res.Header().Get("Last-Modified")
+	ims := r.Header.Get("If-Modified-Since")
+	if lastModified == "" || ims == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+
+	return !modified.After(since)
+}
+
+// etagMatches reports whether etag is one of the (possibly weak, possibly
+// "*") entity tags listed in an If-None-Match header value.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (h *Handler) invalidateResource(res *Resource, r *cacheRequest) {
 	Writes.Add(1)
 
@@ -415,7 +655,25 @@ func (h *Handler) storeResource(res *Resource, r *cacheRequest) {
 	}()
 }
 
-// lookupResource finds the best matching Resource for the
+// lookupResource finds the best candidate Resource for req: a covering
+// byte-range segment from the RangeCache if req carries a Range header,
+// falling back to the whole-resource cache otherwise (or if no covering
+// segment is found). Either way the result is only a candidate - ServeHTTP
+// still runs it through the normal freshness/validation pipeline before
+// serving it, so a cached range segment is bound by the same Cache-Control
+// lifetime as everything else instead of being served forever.
+func (h *Handler) lookupResource(req *cacheRequest) (*Resource, error) {
+	if req.Header.Get("Range") != "" {
+		if res, err := h.lookupRange(req); err == nil {
+			debugf("found a covering cached byte range for %s", req.URL.String())
+			return res, nil
+		}
+	}
+
+	return h.lookup(req)
+}
+
+// lookup finds the best matching whole-resource Resource for the
 // request, or nil and ErrNotFoundInCache if none is found
 func (h *Handler) lookup(req *cacheRequest) (*Resource, error) {
 	res, err := h.cache.Retrieve(req.Key.String())
@@ -0,0 +1,120 @@
+package httpcache
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestBufferedResponse(t *testing.T) {
+	b := newBufferedResponse()
+
+	b.Header().Set("X-Test", "1")
+	b.WriteHeader(http.StatusPartialContent)
+	if _, err := b.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := b.Write([]byte(" world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if b.statusCode != http.StatusPartialContent {
+		t.Fatalf("statusCode = %d, want %d", b.statusCode, http.StatusPartialContent)
+	}
+	if got, want := b.body.String(), "hello world"; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+	if got := b.Header().Get("X-Test"); got != "1" {
+		t.Fatalf("Header().Get(X-Test) = %q, want %q", got, "1")
+	}
+}
+
+func TestBufferedResponseFlushTo(t *testing.T) {
+	b := newBufferedResponse()
+	b.Header().Set("X-Test", "1")
+	b.WriteHeader(http.StatusOK)
+	b.Write([]byte("payload"))
+
+	rec := &recordingResponseWriter{header: make(http.Header)}
+	b.flushTo(rec)
+
+	if rec.statusCode != http.StatusOK {
+		t.Fatalf("flushed statusCode = %d, want %d", rec.statusCode, http.StatusOK)
+	}
+	if rec.body != "payload" {
+		t.Fatalf("flushed body = %q, want %q", rec.body, "payload")
+	}
+	if got := rec.header.Get("X-Test"); got != "1" {
+		t.Fatalf("flushed header X-Test = %q, want %q", got, "1")
+	}
+}
+
+type recordingResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       string
+}
+
+func (r *recordingResponseWriter) Header() http.Header { return r.header }
+
+func (r *recordingResponseWriter) WriteHeader(status int) { r.statusCode = status }
+
+func (r *recordingResponseWriter) Write(p []byte) (int, error) {
+	r.body += string(p)
+	return len(p), nil
+}
+
+// TestSingleflightSharedIsTrueForExecutorToo pins down the singleflight
+// behaviour passUpstream's fix depends on: once two callers overlap on the
+// same key, Do reports shared=true to *all* of them, including whichever
+// goroutine actually ran fn. Code that branches on shared to decide "did I
+// already handle this myself" (as passUpstream used to) is therefore wrong;
+// every caller must do its own post-Do work unconditionally.
+func TestSingleflightSharedIsTrueForExecutorToo(t *testing.T) {
+	var g singleflight.Group
+
+	release := make(chan struct{})
+	entered := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]bool, 2)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, shared := g.Do("key", func() (interface{}, error) {
+			close(entered)
+			<-release
+			return "value", nil
+		})
+		results[0] = shared
+	}()
+
+	<-entered
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, shared := g.Do("key", func() (interface{}, error) {
+			t.Error("second caller should have joined the in-flight call, not executed fn again")
+			return "value", nil
+		})
+		results[1] = shared
+	}()
+
+	// Give the second goroutine a chance to register as a joiner on "key"
+	// before the first one is allowed to finish.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if !results[0] {
+		t.Error("executor's shared = false, want true")
+	}
+	if !results[1] {
+		t.Error("joiner's shared = false, want true")
+	}
+}
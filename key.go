@@ -27,24 +27,11 @@ func NewRequestKey(r *http.Request, storeIdUrl *url.URL) Key {
 	URL, _ := url.Parse(r.URL.String())
 
 	debugf("StoreID url", storeIdUrl )
-	// Here run a query against the StoreID api
-	switch{
-	case (strings.HasSuffix(URL.Host,".sdarot.pm") && strings.HasPrefix(URL.Host,"media")  && strings.HasSuffix(URL.Path, ".mp4") ):
-		debugf("A sdarot.pm video, about to strip query terms from the request key", URL)
-		URL.RawQuery = ""
-		URL.Host = "sdarot.pm.media.ngtech.internal"
-		debugf("A sdarot.pm video, After striping query terms from the request key", URL)
-		debugf("A sdarot.pm video, the request", r)
-	case (strings.HasSuffix(URL.Host,".download.windowsupdate.com") && (strings.HasSuffix(URL.Path, ".exe")  || strings.HasSuffix(URL.Path, ".cab") || strings.HasSuffix(URL.Path, ".esd") )):
-		debugf("A windows updates domain and file, about to strip query terms from the request key", URL)
-		URL.RawQuery = ""
-		URL.Host = "windows.update.ngtech.internal"
-		debugf("A windows updates file, After striping query terms from the request key", URL)
-		debugf("A windows updates file, the request", r)
-
-	default:
-		debugf("Not a special file", URL)
-	}
+	// Run the configurable StoreID rule engine against the request URL,
+	// rewriting it to a canonical form (e.g. stripping query strings and
+	// pointing at a synthetic internal host) before it becomes a Key.
+	// See storeid.go for the rule types and RegisterStoreIDRule/LoadStoreIDRules.
+	URL = applyStoreIDRules(URL, r.Header)
 	if location := r.Header.Get("Content-Location"); location != "" {
 		u, err := url.Parse(location)
 		if err == nil {
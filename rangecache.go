@@ -0,0 +1,296 @@
+package httpcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// byteRange is an inclusive byte interval, as used by the Range and
+// Content-Range headers. end == -1 is the sentinel for an open-ended
+// request range ("bytes=1000-", i.e. "to the end of the resource").
+// total is the full resource size if known (from a Content-Range response;
+// -1 if unknown). It is not set on a request-side byteRange (parseRange
+// leaves it zero) and covers never reads the requested range's total; on
+// the stored side it is what lets covers tell an open-ended request apart
+// from merely "ends late".
+type byteRange struct {
+	start, end int64 // inclusive
+	total      int64
+}
+
+// covers reports whether b fully satisfies a request for o. An open-ended
+// o (o.end == -1) can only be satisfied by a segment that itself reaches
+// the resource's end - otherwise every stored segment would trivially
+// satisfy it, since every real end is >= -1.
+func (b byteRange) covers(o byteRange) bool {
+	if o.end == -1 {
+		return b.total >= 0 && b.end+1 == b.total && b.start <= o.start
+	}
+	return b.start <= o.start && b.end >= o.end
+}
+
+// segmentKey is the cache key a byteRange's body is stored under.
+func segmentKey(key string, rng byteRange) string {
+	return fmt.Sprintf("%s::range=%d-%d", key, rng.start, rng.end)
+}
+
+// RangeCache stores 206 Partial Content responses as byte-range segments
+// alongside an in-memory index of which ranges are present for a given
+// cache Key, so that large binaries (Windows Update .cab/.esd, video, etc)
+// can be assembled from multiple partial fetches instead of re-downloaded
+// whole. Segment bodies are kept in the same underlying Cache as whole
+// resources; only the index of which ranges exist lives in RangeCache.
+type RangeCache struct {
+	cache Cache
+
+	mu    sync.Mutex
+	index map[string][]byteRange
+}
+
+// NewRangeCache returns a RangeCache that stores segment bodies in cache.
+func NewRangeCache(cache Cache) *RangeCache {
+	return &RangeCache{cache: cache, index: make(map[string][]byteRange)}
+}
+
+// StorePartial records a 206 Partial Content response res for key, merging
+// its Content-Range into the segment index and storing the segment body.
+func (rc *RangeCache) StorePartial(res *Resource, key string) error {
+	rng, total, ok := parseContentRange(res.Header().Get("Content-Range"))
+	if !ok {
+		return fmt.Errorf("httpcache: missing or invalid Content-Range on partial response")
+	}
+	rng.total = total
+
+	if err := rc.cache.Store(res, segmentKey(key, rng)); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	rc.index[key] = mergeByteRange(rc.index[key], rng)
+	rc.mu.Unlock()
+
+	return nil
+}
+
+// Covers reports whether every byte of want is present in the index for
+// key, i.e. whether Retrieve can satisfy it without a new upstream fetch.
+func (rc *RangeCache) Covers(key string, want byteRange) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for _, have := range rc.index[key] {
+		if have.covers(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieve returns a Resource satisfying exactly want for key, sliced out
+// of whichever stored segment covers it. It only satisfies requests
+// covered by a single stored segment; gaps spanning multiple segments must
+// be filled upstream first via StorePartial.
+func (rc *RangeCache) Retrieve(key string, want byteRange) (*Resource, error) {
+	rc.mu.Lock()
+	var segment byteRange
+	found := false
+	for _, have := range rc.index[key] {
+		if have.covers(want) {
+			segment = have
+			found = true
+			break
+		}
+	}
+	rc.mu.Unlock()
+
+	if !found {
+		return nil, ErrNotFoundInCache
+	}
+
+	stored, err := rc.cache.Retrieve(segmentKey(key, segment))
+	if err != nil {
+		return nil, err
+	}
+
+	served := want
+	if served.end == -1 {
+		served.end = segment.end
+	}
+
+	return sliceResource(stored, segment, served)
+}
+
+// sliceResource returns a new Resource containing only the bytes of
+// served (a sub-range of segment, both absolute byte offsets) out of
+// stored, with Content-Range/Content-Length rewritten to match. stored is
+// closed before returning.
+func sliceResource(stored *Resource, segment, served byteRange) (*Resource, error) {
+	defer stored.Close()
+
+	body, err := io.ReadAll(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	from := served.start - segment.start
+	to := served.end - segment.start + 1
+	if from < 0 || to > int64(len(body)) || from >= to {
+		return nil, fmt.Errorf("httpcache: requested range %d-%d not within stored segment %d-%d", served.start, served.end, segment.start, segment.end)
+	}
+
+	header := stored.Header().Clone()
+	total := "*"
+	if segment.total >= 0 {
+		total = strconv.FormatInt(segment.total, 10)
+	}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", served.start, served.end, total))
+	header.Set("Content-Length", strconv.FormatInt(to-from, 10))
+
+	return NewResourceBytes(http.StatusPartialContent, body[from:to], header), nil
+}
+
+// mergeByteRange inserts add into ranges, merging it with any overlapping
+// or adjacent ranges, and returns the result sorted by start offset. The
+// merged entry's total is taken from whichever of the ranges being
+// combined knows it (they describe the same resource, so should agree).
+func mergeByteRange(ranges []byteRange, add byteRange) []byteRange {
+	ranges = append(ranges, add)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.end+1 {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			if r.total >= 0 {
+				last.total = r.total
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// parseRange parses a request "Range: bytes=start-end" header. Only the
+// single-range form is supported; multi-range requests are rejected by
+// returning ok=false so the caller can fall back to a full response.
+func parseRange(header string) (byteRange, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return byteRange{}, false
+	}
+
+	spec := strings.TrimPrefix(header, prefix)
+	if strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return byteRange{}, false
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return byteRange{}, false
+	}
+
+	if parts[1] == "" {
+		return byteRange{start: start, end: -1}, true
+	}
+
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return byteRange{}, false
+	}
+
+	return byteRange{start: start, end: end}, true
+}
+
+// parseContentRange parses a response "Content-Range: bytes start-end/total"
+// header, returning the range and the total resource size (-1 if "*").
+func parseContentRange(header string) (byteRange, int64, bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(header, prefix) {
+		return byteRange{}, 0, false
+	}
+
+	spec := strings.TrimPrefix(header, prefix)
+	slash := strings.IndexByte(spec, '/')
+	if slash < 0 {
+		return byteRange{}, 0, false
+	}
+
+	rangePart, totalPart := spec[:slash], spec[slash+1:]
+	dash := strings.IndexByte(rangePart, '-')
+	if dash < 0 {
+		return byteRange{}, 0, false
+	}
+
+	start, err := strconv.ParseInt(rangePart[:dash], 10, 64)
+	if err != nil {
+		return byteRange{}, 0, false
+	}
+	end, err := strconv.ParseInt(rangePart[dash+1:], 10, 64)
+	if err != nil {
+		return byteRange{}, 0, false
+	}
+
+	total := int64(-1)
+	if totalPart != "*" {
+		total, err = strconv.ParseInt(totalPart, 10, 64)
+		if err != nil {
+			return byteRange{}, 0, false
+		}
+	}
+
+	return byteRange{start: start, end: end}, total, true
+}
+
+// SetRangeCache enables Range/Partial-Content support on h, storing and
+// serving byte-range segments through rc in addition to h's normal cache.
+func (h *Handler) SetRangeCache(rc *RangeCache) {
+	h.rangeCache = rc
+}
+
+// storeRangeResource stores a 206 response's byte range in h.rangeCache, if
+// one is configured; otherwise the segment is dropped since a plain Cache
+// has no way to merge or address partial content.
+func (h *Handler) storeRangeResource(res *Resource, r *cacheRequest) {
+	if h.rangeCache == nil {
+		debugf("partial content received but no RangeCache configured, discarding")
+		return
+	}
+
+	Writes.Add(1)
+	go func() {
+		defer Writes.Done()
+		if err := h.rangeCache.StorePartial(res, r.Key.String()); err != nil {
+			errorf("storing partial content for %s failed: %s", r.Key.String(), err.Error())
+		}
+	}()
+}
+
+// lookupRange attempts to satisfy a Range GET for r entirely from
+// h.rangeCache, returning ErrNotFoundInCache if the requested range isn't
+// fully covered by a stored segment yet.
+func (h *Handler) lookupRange(r *cacheRequest) (*Resource, error) {
+	if h.rangeCache == nil {
+		return nil, ErrNotFoundInCache
+	}
+
+	want, ok := parseRange(r.Header.Get("Range"))
+	if !ok {
+		return nil, ErrNotFoundInCache
+	}
+
+	return h.rangeCache.Retrieve(r.Key.String(), want)
+}
@@ -0,0 +1,132 @@
+package httpcache
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		want   byteRange
+		ok     bool
+	}{
+		{"bytes=0-499", byteRange{start: 0, end: 499}, true},
+		{"bytes=1000-", byteRange{start: 1000, end: -1}, true},
+		{"bytes=500-999,1000-1499", byteRange{}, false},
+		{"not-bytes=0-1", byteRange{}, false},
+		{"bytes=abc-1", byteRange{}, false},
+	}
+
+	for _, c := range cases {
+		got, ok := parseRange(c.header)
+		if ok != c.ok {
+			t.Errorf("parseRange(%q) ok = %v, want %v", c.header, ok, c.ok)
+			continue
+		}
+		if ok && got != c.want {
+			t.Errorf("parseRange(%q) = %+v, want %+v", c.header, got, c.want)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	rng, total, ok := parseContentRange("bytes 0-499/1234")
+	if !ok {
+		t.Fatal("parseContentRange returned ok=false for a valid header")
+	}
+	if rng != (byteRange{start: 0, end: 499}) {
+		t.Errorf("rng = %+v, want {0 499 0}", rng)
+	}
+	if total != 1234 {
+		t.Errorf("total = %d, want 1234", total)
+	}
+
+	_, total, ok = parseContentRange("bytes 0-499/*")
+	if !ok {
+		t.Fatal("parseContentRange returned ok=false for an unknown-total header")
+	}
+	if total != -1 {
+		t.Errorf("total = %d, want -1 for unknown total", total)
+	}
+
+	if _, _, ok := parseContentRange("not-bytes 0-499/1234"); ok {
+		t.Error("parseContentRange accepted a malformed header")
+	}
+}
+
+func TestByteRangeCovers(t *testing.T) {
+	cases := []struct {
+		name string
+		have byteRange
+		want byteRange
+		ok   bool
+	}{
+		{
+			name: "exact match",
+			have: byteRange{start: 0, end: 999, total: 1000},
+			want: byteRange{start: 0, end: 999},
+			ok:   true,
+		},
+		{
+			name: "superset covers subset",
+			have: byteRange{start: 0, end: 999, total: 1000},
+			want: byteRange{start: 500, end: 600},
+			ok:   true,
+		},
+		{
+			name: "partial segment does not cover larger request",
+			have: byteRange{start: 0, end: 499, total: 1000},
+			want: byteRange{start: 0, end: 999},
+			ok:   false,
+		},
+		{
+			name: "open-ended request satisfied only by a segment reaching EOF",
+			have: byteRange{start: 0, end: 1499, total: 2000},
+			want: byteRange{start: 1000, end: -1},
+			ok:   false,
+		},
+		{
+			name: "open-ended request satisfied by a segment that reaches EOF",
+			have: byteRange{start: 0, end: 1999, total: 2000},
+			want: byteRange{start: 1000, end: -1},
+			ok:   true,
+		},
+		{
+			name: "open-ended request against a segment of unknown total never matches",
+			have: byteRange{start: 0, end: 1999, total: -1},
+			want: byteRange{start: 1000, end: -1},
+			ok:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.have.covers(c.want); got != c.ok {
+				t.Errorf("%+v.covers(%+v) = %v, want %v", c.have, c.want, got, c.ok)
+			}
+		})
+	}
+}
+
+func TestMergeByteRange(t *testing.T) {
+	ranges := mergeByteRange(nil, byteRange{start: 0, end: 499, total: 2000})
+	ranges = mergeByteRange(ranges, byteRange{start: 500, end: 999, total: 2000})
+
+	if len(ranges) != 1 {
+		t.Fatalf("adjacent ranges did not merge: %+v", ranges)
+	}
+	if ranges[0] != (byteRange{start: 0, end: 999, total: 2000}) {
+		t.Errorf("merged range = %+v, want {0 999 2000}", ranges[0])
+	}
+
+	ranges = mergeByteRange(ranges, byteRange{start: 1500, end: 1999, total: 2000})
+	if len(ranges) != 2 {
+		t.Fatalf("disjoint range should not merge: %+v", ranges)
+	}
+
+	ranges = mergeByteRange(ranges, byteRange{start: 1000, end: 1499, total: 2000})
+	if len(ranges) != 1 {
+		t.Fatalf("gap-filling range should merge everything into one: %+v", ranges)
+	}
+	if ranges[0] != (byteRange{start: 0, end: 1999, total: 2000}) {
+		t.Errorf("merged range = %+v, want {0 1999 2000}", ranges[0])
+	}
+}
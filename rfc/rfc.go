@@ -0,0 +1,285 @@
+// Package rfc holds the RFC 7234 (HTTP Caching) decision logic shared by
+// httpcache's Handler and, via the transport package, by its RoundTripper.
+// Every function here is pure: it takes headers, timestamps and small
+// value types rather than *httpcache.Resource, so it can be exercised with
+// a conformance test suite independent of any particular cache storage.
+package rfc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl is a parsed Cache-Control header. It has the same
+// underlying type as httpcache.CacheControl, so values of that type convert
+// to this one for free at the package boundary (rfc.CacheControl(cc)).
+type CacheControl map[string][]string
+
+// Has reports whether directive was present in the header.
+func (cc CacheControl) Has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// Get returns directive's first value, if any.
+func (cc CacheControl) Get(directive string) (string, bool) {
+	v, ok := cc[directive]
+	if !ok || len(v) == 0 {
+		return "", ok
+	}
+	return v[0], ok
+}
+
+// Duration parses directive's value as a delta-seconds value.
+func (cc CacheControl) Duration(directive string) (time.Duration, error) {
+	v, ok := cc.Get(directive)
+	if !ok {
+		return 0, fmt.Errorf("rfc: %q not present in Cache-Control", directive)
+	}
+
+	seconds, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("rfc: %q is not delta-seconds: %w", directive, err)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Storeable lists response statuses that may be written to cache storage
+// at all (independent of freshness/cacheability), per RFC 7234 section 3.
+var Storeable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusFound:                true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusGone:                 true,
+	http.StatusNotFound:             true,
+	http.StatusPartialContent:       true,
+}
+
+// CacheableByDefault lists response statuses that are cacheable even
+// without an explicit freshness lifetime, per RFC 7234 section 3.
+var CacheableByDefault = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusFound:                true,
+	http.StatusNotModified:          true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusGone:                 true,
+	http.StatusPartialContent:       true,
+}
+
+// CorrectedAge adjusts a response's Age for clock skew and transit time.
+// https://httpwg.github.io/specs/rfc7234.html#rfc.section.4.2.3
+func CorrectedAge(h http.Header, reqTime, respTime, now time.Time) (time.Duration, error) {
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return 0, err
+	}
+
+	apparentAge := respTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	respDelay := respTime.Sub(reqTime)
+	ageSeconds, _ := strconv.Atoi(h.Get("Age"))
+	age := time.Second*time.Duration(ageSeconds) + respDelay
+
+	correctedAge := age
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+
+	return correctedAge + now.Sub(respTime), nil
+}
+
+// FreshnessInput bundles the facts Freshness needs about a resource and the
+// request asking for it.
+type FreshnessInput struct {
+	MaxAge              time.Duration
+	Age                 time.Duration
+	IsStale             bool
+	HeuristicFreshness  time.Duration
+	RequestCacheControl CacheControl
+}
+
+// Freshness returns the duration a resource described by in will remain
+// fresh for, which may be negative (stale). See RFC 7234 section 4.2.
+//
+// A malformed request max-age is reported as an error rather than treated
+// as absent: a client that can't even send a well-formed directive can't be
+// trusted to mean "no limit", so the caller should fail closed (force
+// revalidation) rather than silently honour the cached response's own
+// freshness.
+func Freshness(in FreshnessInput) (time.Duration, error) {
+	maxAge := in.MaxAge
+
+	if in.RequestCacheControl.Has("max-age") {
+		reqMaxAge, err := in.RequestCacheControl.Duration("max-age")
+		if err != nil {
+			return 0, fmt.Errorf("rfc: request max-age: %w", err)
+		}
+		if reqMaxAge < maxAge {
+			maxAge = reqMaxAge
+		}
+	}
+
+	if in.IsStale {
+		return 0, nil
+	}
+
+	if in.HeuristicFreshness > maxAge {
+		maxAge = in.HeuristicFreshness
+	}
+
+	return maxAge - in.Age, nil
+}
+
+// NeedsValidationInput bundles the facts NeedsValidation needs.
+type NeedsValidationInput struct {
+	MustValidate        bool
+	Freshness           time.Duration
+	RequestCacheControl CacheControl
+}
+
+// NeedsValidation reports whether a cached response must be validated (or
+// refetched) before being served for the given request, per RFC 7234
+// sections 4 and 5.2.1.
+//
+// A malformed request min-fresh or max-stale is reported as an error rather
+// than treated as absent, and the caller should fail closed (validation
+// required) rather than let an unparseable directive silently waive it.
+func NeedsValidation(in NeedsValidationInput) (bool, error) {
+	if in.MustValidate {
+		return true, nil
+	}
+
+	if in.RequestCacheControl.Has("min-fresh") {
+		reqMinFresh, err := in.RequestCacheControl.Duration("min-fresh")
+		if err != nil {
+			return true, fmt.Errorf("rfc: request min-fresh: %w", err)
+		}
+		if in.Freshness < reqMinFresh {
+			return true, nil
+		}
+	}
+
+	if in.Freshness <= 0 && in.RequestCacheControl.Has("max-stale") {
+		if len(in.RequestCacheControl["max-stale"]) == 0 {
+			return false, nil
+		}
+		maxStale, err := in.RequestCacheControl.Duration("max-stale")
+		if err != nil {
+			return true, fmt.Errorf("rfc: request max-stale: %w", err)
+		}
+		if maxStale >= (in.Freshness * -1) {
+			return false, nil
+		}
+	}
+
+	return in.Freshness <= 0, nil
+}
+
+// IsCacheableInput bundles the facts IsCacheable needs about a response and
+// the request that produced it.
+type IsCacheableInput struct {
+	Status                int
+	ResponseCacheControl  CacheControl
+	RequestHasAuth        bool
+	ResponseHasAuth       bool
+	Shared                bool
+	HasExplicitExpiration bool
+	HasValidators         bool
+	HeuristicFreshness    time.Duration
+}
+
+// IsCacheable reports whether a response may be stored in a shared or
+// private cache, per RFC 7234 section 3.
+func IsCacheable(in IsCacheableInput) bool {
+	cc := in.ResponseCacheControl
+
+	if cc.Has("no-cache") || cc.Has("no-store") {
+		return false
+	}
+
+	if cc.Has("private") && len(cc["private"]) == 0 && in.Shared {
+		return false
+	}
+
+	if _, ok := Storeable[in.Status]; !ok {
+		return false
+	}
+
+	if in.RequestHasAuth && in.Shared {
+		return false
+	}
+
+	if in.ResponseHasAuth && in.Shared && !cc.Has("must-revalidate") && !cc.Has("s-maxage") {
+		return false
+	}
+
+	if in.HasExplicitExpiration {
+		return true
+	}
+
+	if _, ok := CacheableByDefault[in.Status]; !ok && !cc.Has("public") {
+		return false
+	}
+
+	if in.HasValidators {
+		return true
+	}
+
+	return in.HeuristicFreshness > 0
+}
+
+// ParseCacheControl parses a Cache-Control header value into a CacheControl.
+// Malformed directives (no name) are skipped rather than erroring, since a
+// single bad directive shouldn't make the rest of the header unusable.
+func ParseCacheControl(header string) CacheControl {
+	cc := CacheControl{}
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if value == "" {
+			cc[name] = []string{}
+		} else {
+			cc[name] = append(cc[name], value)
+		}
+	}
+
+	return cc
+}
+
+// VaryMatches reports whether two requests agree on every header named in
+// varyHeader (a comma-separated Vary header value), i.e. whether a
+// response varied on that header can be reused for both requests.
+func VaryMatches(varyHeader string, a, b http.Header) bool {
+	for _, header := range strings.Split(varyHeader, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if a.Get(header) != b.Get(header) {
+			return false
+		}
+	}
+	return true
+}
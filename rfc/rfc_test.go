@@ -0,0 +1,377 @@
+package rfc
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	cases := []struct {
+		name string
+		in   FreshnessInput
+		want time.Duration
+		ok   bool
+	}{
+		{
+			name: "fresh",
+			in:   FreshnessInput{MaxAge: 100 * time.Second, Age: 10 * time.Second},
+			want: 90 * time.Second,
+			ok:   true,
+		},
+		{
+			name: "stale by age",
+			in:   FreshnessInput{MaxAge: 100 * time.Second, Age: 200 * time.Second},
+			want: -100 * time.Second,
+			ok:   true,
+		},
+		{
+			name: "explicitly stale short-circuits to zero",
+			in:   FreshnessInput{MaxAge: 100 * time.Second, Age: 10 * time.Second, IsStale: true},
+			want: 0,
+			ok:   true,
+		},
+		{
+			name: "heuristic freshness used when larger than max-age",
+			in:   FreshnessInput{MaxAge: 10 * time.Second, Age: 5 * time.Second, HeuristicFreshness: 100 * time.Second},
+			want: 95 * time.Second,
+			ok:   true,
+		},
+		{
+			name: "request max-age narrows the freshness lifetime",
+			in: FreshnessInput{
+				MaxAge:              100 * time.Second,
+				Age:                 10 * time.Second,
+				RequestCacheControl: CacheControl{"max-age": {"20"}},
+			},
+			want: 10 * time.Second,
+			ok:   true,
+		},
+		{
+			name: "request max-age larger than response max-age is ignored",
+			in: FreshnessInput{
+				MaxAge:              100 * time.Second,
+				Age:                 10 * time.Second,
+				RequestCacheControl: CacheControl{"max-age": {"200"}},
+			},
+			want: 90 * time.Second,
+			ok:   true,
+		},
+		{
+			name: "malformed request max-age fails closed",
+			in: FreshnessInput{
+				MaxAge:              100 * time.Second,
+				Age:                 10 * time.Second,
+				RequestCacheControl: CacheControl{"max-age": {"not-a-number"}},
+			},
+			ok: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Freshness(c.in)
+			if (err == nil) != c.ok {
+				t.Fatalf("Freshness() error = %v, want ok = %v", err, c.ok)
+			}
+			if err == nil && got != c.want {
+				t.Errorf("Freshness() = %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestNeedsValidation(t *testing.T) {
+	cases := []struct {
+		name string
+		in   NeedsValidationInput
+		want bool
+		ok   bool
+	}{
+		{
+			name: "fresh response does not need validation",
+			in:   NeedsValidationInput{Freshness: 10 * time.Second},
+			want: false,
+			ok:   true,
+		},
+		{
+			name: "stale response needs validation",
+			in:   NeedsValidationInput{Freshness: -10 * time.Second},
+			want: true,
+			ok:   true,
+		},
+		{
+			name: "must-revalidate forces validation even when fresh",
+			in:   NeedsValidationInput{Freshness: 10 * time.Second, MustValidate: true},
+			want: true,
+			ok:   true,
+		},
+		{
+			name: "min-fresh requires more freshness than is left",
+			in: NeedsValidationInput{
+				Freshness:           10 * time.Second,
+				RequestCacheControl: CacheControl{"min-fresh": {"20"}},
+			},
+			want: true,
+			ok:   true,
+		},
+		{
+			name: "min-fresh satisfied",
+			in: NeedsValidationInput{
+				Freshness:           30 * time.Second,
+				RequestCacheControl: CacheControl{"min-fresh": {"20"}},
+			},
+			want: false,
+			ok:   true,
+		},
+		{
+			name: "malformed min-fresh fails closed",
+			in: NeedsValidationInput{
+				Freshness:           30 * time.Second,
+				RequestCacheControl: CacheControl{"min-fresh": {"not-a-number"}},
+			},
+			ok: false,
+		},
+		{
+			name: "bare max-stale waives any staleness",
+			in: NeedsValidationInput{
+				Freshness:           -30 * time.Second,
+				RequestCacheControl: CacheControl{"max-stale": {}},
+			},
+			want: false,
+			ok:   true,
+		},
+		{
+			name: "max-stale within bound waives validation",
+			in: NeedsValidationInput{
+				Freshness:           -10 * time.Second,
+				RequestCacheControl: CacheControl{"max-stale": {"20"}},
+			},
+			want: false,
+			ok:   true,
+		},
+		{
+			name: "max-stale exceeded still needs validation",
+			in: NeedsValidationInput{
+				Freshness:           -30 * time.Second,
+				RequestCacheControl: CacheControl{"max-stale": {"10"}},
+			},
+			want: true,
+			ok:   true,
+		},
+		{
+			name: "malformed max-stale fails closed",
+			in: NeedsValidationInput{
+				Freshness:           -30 * time.Second,
+				RequestCacheControl: CacheControl{"max-stale": {"not-a-number"}},
+			},
+			ok: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := NeedsValidation(c.in)
+			if (err == nil) != c.ok {
+				t.Fatalf("NeedsValidation() error = %v, want ok = %v", err, c.ok)
+			}
+			if err == nil && got != c.want {
+				t.Errorf("NeedsValidation() = %v, want %v", got, c.want)
+			}
+			if err != nil && !got {
+				t.Errorf("NeedsValidation() = %v on error, want true (fail closed)", got)
+			}
+		})
+	}
+}
+
+func TestIsCacheable(t *testing.T) {
+	cases := []struct {
+		name string
+		in   IsCacheableInput
+		want bool
+	}{
+		{
+			name: "plain 200 with explicit expiration is cacheable",
+			in:   IsCacheableInput{Status: http.StatusOK, ResponseCacheControl: CacheControl{}, HasExplicitExpiration: true},
+			want: true,
+		},
+		{
+			name: "no-store is never cacheable",
+			in:   IsCacheableInput{Status: http.StatusOK, ResponseCacheControl: CacheControl{"no-store": {}}, HasExplicitExpiration: true},
+			want: false,
+		},
+		{
+			name: "no-cache is never cacheable",
+			in:   IsCacheableInput{Status: http.StatusOK, ResponseCacheControl: CacheControl{"no-cache": {}}, HasExplicitExpiration: true},
+			want: false,
+		},
+		{
+			name: "bare private is not cacheable in a shared cache",
+			in: IsCacheableInput{
+				Status:                http.StatusOK,
+				ResponseCacheControl:  CacheControl{"private": {}},
+				Shared:                true,
+				HasExplicitExpiration: true,
+			},
+			want: false,
+		},
+		{
+			name: "bare private is cacheable in a private cache",
+			in: IsCacheableInput{
+				Status:                http.StatusOK,
+				ResponseCacheControl:  CacheControl{"private": {}},
+				Shared:                false,
+				HasExplicitExpiration: true,
+			},
+			want: true,
+		},
+		{
+			name: "status not in Storeable is never cacheable",
+			in:   IsCacheableInput{Status: http.StatusTeapot, ResponseCacheControl: CacheControl{}, HasExplicitExpiration: true},
+			want: false,
+		},
+		{
+			name: "request auth header blocks shared caching",
+			in: IsCacheableInput{
+				Status:                http.StatusOK,
+				ResponseCacheControl:  CacheControl{},
+				RequestHasAuth:        true,
+				Shared:                true,
+				HasExplicitExpiration: true,
+			},
+			want: false,
+		},
+		{
+			name: "response auth header blocks shared caching unless must-revalidate/s-maxage",
+			in: IsCacheableInput{
+				Status:                http.StatusOK,
+				ResponseCacheControl:  CacheControl{},
+				ResponseHasAuth:       true,
+				Shared:                true,
+				HasExplicitExpiration: true,
+			},
+			want: false,
+		},
+		{
+			name: "response auth header allowed in shared cache with must-revalidate",
+			in: IsCacheableInput{
+				Status:                http.StatusOK,
+				ResponseCacheControl:  CacheControl{"must-revalidate": {}},
+				ResponseHasAuth:       true,
+				Shared:                true,
+				HasExplicitExpiration: true,
+			},
+			want: true,
+		},
+		{
+			name: "cacheable-by-default status without expiration needs validators or heuristic freshness",
+			in:   IsCacheableInput{Status: http.StatusOK, ResponseCacheControl: CacheControl{}},
+			want: false,
+		},
+		{
+			name: "cacheable-by-default status with validators is cacheable without expiration",
+			in:   IsCacheableInput{Status: http.StatusOK, ResponseCacheControl: CacheControl{}, HasValidators: true},
+			want: true,
+		},
+		{
+			name: "cacheable-by-default status with heuristic freshness is cacheable",
+			in:   IsCacheableInput{Status: http.StatusOK, ResponseCacheControl: CacheControl{}, HeuristicFreshness: time.Second},
+			want: true,
+		},
+		{
+			name: "status not cacheable by default needs public",
+			in:   IsCacheableInput{Status: http.StatusNotFound, ResponseCacheControl: CacheControl{}, HasValidators: true},
+			want: false,
+		},
+		{
+			name: "public makes a not-cacheable-by-default status eligible",
+			in: IsCacheableInput{
+				Status:               http.StatusNotFound,
+				ResponseCacheControl: CacheControl{"public": {}},
+				HasValidators:        true,
+			},
+			want: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := IsCacheable(c.in); got != c.want {
+				t.Errorf("IsCacheable() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCorrectedAge(t *testing.T) {
+	reqTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	respTime := reqTime.Add(2 * time.Second)
+	now := respTime.Add(3 * time.Second)
+
+	header := http.Header{}
+	header.Set("Date", respTime.Format(http.TimeFormat))
+	header.Set("Age", "5")
+
+	age, err := CorrectedAge(header, reqTime, respTime, now)
+	if err != nil {
+		t.Fatalf("CorrectedAge() error = %v", err)
+	}
+
+	// age header (5s) + response delay (2s) + time since response (3s) = 10s,
+	// and apparent age (respTime - Date = 0s) doesn't exceed it.
+	if want := 10 * time.Second; age != want {
+		t.Errorf("CorrectedAge() = %s, want %s", age, want)
+	}
+
+	if _, err := CorrectedAge(http.Header{}, reqTime, respTime, now); err == nil {
+		t.Error("CorrectedAge() with no Date header: want error, got nil")
+	}
+}
+
+func TestCorrectedAgeUsesApparentAgeWhenLarger(t *testing.T) {
+	reqTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	respTime := reqTime.Add(1 * time.Second)
+	now := respTime
+
+	header := http.Header{}
+	// Date far in the past makes the apparent age (respTime - Date) dwarf
+	// the Age-header-derived age.
+	header.Set("Date", reqTime.Add(-1*time.Hour).Format(http.TimeFormat))
+	header.Set("Age", "0")
+
+	age, err := CorrectedAge(header, reqTime, respTime, now)
+	if err != nil {
+		t.Fatalf("CorrectedAge() error = %v", err)
+	}
+
+	if age < time.Hour {
+		t.Errorf("CorrectedAge() = %s, want at least 1h (apparent age should dominate)", age)
+	}
+}
+
+func TestVaryMatches(t *testing.T) {
+	a := http.Header{}
+	a.Set("Accept-Encoding", "gzip")
+	a.Set("Authorization", "token-a")
+
+	b := http.Header{}
+	b.Set("Accept-Encoding", "gzip")
+	b.Set("Authorization", "token-b")
+
+	if !VaryMatches("Accept-Encoding", a, b) {
+		t.Error(`VaryMatches("Accept-Encoding") = false, want true (both gzip)`)
+	}
+
+	if VaryMatches("Authorization", a, b) {
+		t.Error(`VaryMatches("Authorization") = true, want false (tokens differ)`)
+	}
+
+	if VaryMatches("Accept-Encoding, Authorization", a, b) {
+		t.Error(`VaryMatches("Accept-Encoding, Authorization") = true, want false`)
+	}
+
+	if !VaryMatches("", a, b) {
+		t.Error(`VaryMatches("") = false, want true (no headers to agree on)`)
+	}
+}
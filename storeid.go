@@ -0,0 +1,249 @@
+package httpcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// StoreIDRule describes a single matcher/action pair used to rewrite a
+// request's URL before it is turned into a cache Key. Rules are evaluated
+// in registration order and the first matching rule wins, mirroring
+// cdp-cache's RuleMatcher design.
+type StoreIDRule struct {
+	// Match selects which requests this rule applies to.
+	Match StoreIDMatch `json:"match" yaml:"match"`
+
+	// Action is applied to the request URL once Match succeeds.
+	Action StoreIDAction `json:"action" yaml:"action"`
+}
+
+// StoreIDMatch selects requests by host, path or header.
+type StoreIDMatch struct {
+	// Type is one of "host", "path" or "header".
+	Type string `json:"type" yaml:"type"`
+
+	// Host, when Type is "host", is matched as a suffix against the
+	// request's URL host (e.g. ".download.windowsupdate.com").
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+
+	// HostPrefix, when set, additionally requires the URL host to start
+	// with this prefix (e.g. "media" to distinguish media.sdarot.pm from
+	// other *.sdarot.pm subdomains).
+	HostPrefix string `json:"host_prefix,omitempty" yaml:"host_prefix,omitempty"`
+
+	// PathSuffix, when Type is "path" (or as an extra constraint on a
+	// "host" match), is matched as a suffix against the request's URL path
+	// (e.g. ".cab").
+	PathSuffix string `json:"path_suffix,omitempty" yaml:"path_suffix,omitempty"`
+
+	// PathSuffixes is like PathSuffix but matches if the URL path ends in
+	// any one of the listed suffixes (e.g. [".exe", ".cab", ".esd"]).
+	PathSuffixes []string `json:"path_suffixes,omitempty" yaml:"path_suffixes,omitempty"`
+
+	// Header and HeaderValue, when Type is "header", require the named
+	// request header to be present (and, if HeaderValue is non-empty,
+	// to equal it).
+	Header      string `json:"header,omitempty" yaml:"header,omitempty"`
+	HeaderValue string `json:"header_value,omitempty" yaml:"header_value,omitempty"`
+}
+
+// StoreIDAction rewrites the request URL once a StoreIDMatch has fired.
+type StoreIDAction struct {
+	// StripQuery drops the entire query string.
+	StripQuery bool `json:"strip_query,omitempty" yaml:"strip_query,omitempty"`
+
+	// StripQueryParams drops only the listed query parameters.
+	StripQueryParams []string `json:"strip_query_params,omitempty" yaml:"strip_query_params,omitempty"`
+
+	// RewriteHost replaces the URL host with a synthetic internal one.
+	RewriteHost string `json:"rewrite_host,omitempty" yaml:"rewrite_host,omitempty"`
+
+	// RegexMatch, when set, is compiled as a regular expression and every
+	// match in the URL path is replaced with RegexReplace.
+	RegexMatch   string `json:"regex_match,omitempty" yaml:"regex_match,omitempty"`
+	RegexReplace string `json:"regex_replace,omitempty" yaml:"regex_replace,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+var (
+	storeIDRulesMu sync.RWMutex
+	storeIDRules   []StoreIDRule
+)
+
+func init() {
+	// Preserve the previously hardcoded sdarot.pm and windowsupdate.com
+	// behaviour as the built-in default rules, constraints and all: the
+	// sdarot.pm rule only ever applied to hosts starting with "media", and
+	// the windowsupdate.com rule only to the three binary extensions -
+	// dropping either constraint would collapse distinct origins (or
+	// manifests/catalogs alongside binaries) onto the same cache key.
+	RegisterStoreIDRule(StoreIDRule{
+		Match: StoreIDMatch{
+			Type:       "host",
+			Host:       ".sdarot.pm",
+			HostPrefix: "media",
+			PathSuffix: ".mp4",
+		},
+		Action: StoreIDAction{
+			StripQuery:  true,
+			RewriteHost: "sdarot.pm.media.ngtech.internal",
+		},
+	})
+	RegisterStoreIDRule(StoreIDRule{
+		Match: StoreIDMatch{
+			Type:         "host",
+			Host:         ".download.windowsupdate.com",
+			PathSuffixes: []string{".exe", ".cab", ".esd"},
+		},
+		Action: StoreIDAction{
+			StripQuery:  true,
+			RewriteHost: "windows.update.ngtech.internal",
+		},
+	})
+}
+
+// RegisterStoreIDRule appends a StoreID rule to the rule engine. Rules are
+// evaluated in the order they were registered and the first match wins.
+func RegisterStoreIDRule(rule StoreIDRule) error {
+	if rule.Action.RegexMatch != "" {
+		re, err := regexp.Compile(rule.Action.RegexMatch)
+		if err != nil {
+			return err
+		}
+		rule.Action.regex = re
+	}
+
+	storeIDRulesMu.Lock()
+	defer storeIDRulesMu.Unlock()
+	storeIDRules = append(storeIDRules, rule)
+	return nil
+}
+
+// ResetStoreIDRules clears every registered rule, including the built-in
+// defaults. Mainly useful for tests and for operators who want to fully
+// replace the rule set via config.
+func ResetStoreIDRules() {
+	storeIDRulesMu.Lock()
+	defer storeIDRulesMu.Unlock()
+	storeIDRules = nil
+}
+
+// storeIDConfig is the on-disk shape of a StoreID rule file.
+type storeIDConfig struct {
+	Rules []StoreIDRule `json:"rules" yaml:"rules"`
+}
+
+// LoadStoreIDRules reads StoreID rules from a JSON config file and
+// registers them, appending to any already-registered rules. YAML configs
+// can be supported the same way once a YAML decoder is vendored; for now
+// operators should convert YAML to JSON before loading it.
+func LoadStoreIDRules(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var cfg storeIDConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+
+	for _, rule := range cfg.Rules {
+		if err := RegisterStoreIDRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyStoreIDRules evaluates the registered StoreID rules against URL and
+// header, returning the rewritten URL. If no rule matches, URL is returned
+// unchanged.
+func applyStoreIDRules(URL *url.URL, header http.Header) *url.URL {
+	storeIDRulesMu.RLock()
+	rules := storeIDRules
+	storeIDRulesMu.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.Match.matches(URL, header) {
+			continue
+		}
+
+		debugf("StoreID rule matched, rewriting key URL", URL)
+		rule.Action.apply(URL)
+		return URL
+	}
+
+	return URL
+}
+
+func (m StoreIDMatch) matches(URL *url.URL, header http.Header) bool {
+	switch m.Type {
+	case "host":
+		if m.Host != "" && !strings.HasSuffix(URL.Host, m.Host) {
+			return false
+		}
+		if m.HostPrefix != "" && !strings.HasPrefix(URL.Host, m.HostPrefix) {
+			return false
+		}
+		if m.PathSuffix != "" && !strings.HasSuffix(URL.Path, m.PathSuffix) {
+			return false
+		}
+		if len(m.PathSuffixes) > 0 && !hasAnySuffix(URL.Path, m.PathSuffixes) {
+			return false
+		}
+		return true
+	case "path":
+		if m.PathSuffix != "" {
+			return strings.HasSuffix(URL.Path, m.PathSuffix)
+		}
+		return len(m.PathSuffixes) > 0 && hasAnySuffix(URL.Path, m.PathSuffixes)
+	case "header":
+		if m.Header == "" {
+			return false
+		}
+		value := header.Get(m.Header)
+		if value == "" {
+			return false
+		}
+		return m.HeaderValue == "" || value == m.HeaderValue
+	default:
+		return false
+	}
+}
+
+// hasAnySuffix reports whether s ends in any one of suffixes.
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a StoreIDAction) apply(URL *url.URL) {
+	if a.StripQuery {
+		URL.RawQuery = ""
+	} else if len(a.StripQueryParams) > 0 {
+		q := URL.Query()
+		for _, param := range a.StripQueryParams {
+			q.Del(param)
+		}
+		URL.RawQuery = q.Encode()
+	}
+
+	if a.RewriteHost != "" {
+		URL.Host = a.RewriteHost
+	}
+
+	if a.regex != nil {
+		URL.Path = a.regex.ReplaceAllString(URL.Path, a.RegexReplace)
+	}
+}
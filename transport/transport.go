@@ -0,0 +1,246 @@
+// Package transport provides an http.RoundTripper that caches responses
+// using the same RFC 7234 decision logic as httpcache.Handler (see the rfc
+// package), so a cache can be dropped into an http.Client instead of
+// fronting a server with httpcache.NewHandler.
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elico/httpcache/rfc"
+)
+
+// CachedResponse is a stored response, serialized enough to be replayed
+// without the original *http.Response (whose Body is a one-shot reader).
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// RequestHeader is the header of the request that produced this
+	// response, kept so a later request can be checked against it via
+	// rfc.VaryMatches if Header carries a Vary directive.
+	RequestHeader http.Header
+
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// Store persists CachedResponses by key. Store implementations must be
+// safe for concurrent use.
+type Store interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, res *CachedResponse)
+}
+
+// MemoryStore is a simple, unbounded in-memory Store, useful for tests and
+// small clients; production users will likely want to provide their own
+// Store backed by the same disk/tiered backends used with Handler.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	items map[string]*CachedResponse
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]*CachedResponse)}
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(key string) (*CachedResponse, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res, ok := s.items[key]
+	return res, ok
+}
+
+// Set implements Store.
+func (s *MemoryStore) Set(key string, res *CachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[key] = res
+}
+
+// Transport is an http.RoundTripper that serves cacheable requests from a
+// Store and otherwise delegates to an underlying RoundTripper, storing
+// cacheable responses for next time.
+type Transport struct {
+	// Transport is the underlying RoundTripper used for actual requests.
+	// Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// Store holds cached responses. NewTransport sets it to a fresh
+	// MemoryStore; it must not be nil when RoundTrip is called.
+	Store Store
+
+	// Shared marks the Transport as a shared (rather than private) cache
+	// for the purposes of RFC 7234's private/s-maxage handling.
+	Shared bool
+}
+
+// NewTransport returns a Transport backed by a MemoryStore.
+func NewTransport(rt http.RoundTripper) *Transport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Transport{Transport: rt, Store: NewMemoryStore()}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isCacheableRequest(req) {
+		return t.roundTrip(req)
+	}
+
+	key := cacheKey(req)
+
+	if cached, ok := t.Store.Get(key); ok && varyMatches(cached, req) {
+		if !t.needsValidation(cached, req) {
+			return cached.toResponse(req), nil
+		}
+	}
+
+	resp, err := t.roundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	t.maybeStore(key, req, resp)
+	return resp, nil
+}
+
+func (t *Transport) roundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return rt.RoundTrip(req)
+}
+
+// varyMatches reports whether req agrees with the request that produced
+// cached on every header cached's response varied on, per RFC 7234 section
+// 4.1. A response with no Vary header matches any request, since it never
+// claimed to vary on anything.
+func varyMatches(cached *CachedResponse, req *http.Request) bool {
+	vary := cached.Header.Get("Vary")
+	if vary == "" {
+		return true
+	}
+	return rfc.VaryMatches(vary, cached.RequestHeader, req.Header)
+}
+
+// needsValidation fails closed: any error computing freshness, including a
+// malformed request max-age/min-fresh/max-stale directive, is treated as
+// "validation required" rather than silently ignored.
+func (t *Transport) needsValidation(cached *CachedResponse, req *http.Request) bool {
+	cc := rfc.ParseCacheControl(cached.Header.Get("Cache-Control"))
+	reqCC := rfc.ParseCacheControl(req.Header.Get("Cache-Control"))
+
+	maxAge, hasMaxAge := time.Duration(0), false
+	if d, err := cc.Duration("max-age"); err == nil {
+		maxAge, hasMaxAge = d, true
+	}
+	if !hasMaxAge && !cc.Has("no-cache") {
+		if expires, err := http.ParseTime(cached.Header.Get("Expires")); err == nil {
+			maxAge = expires.Sub(cached.ResponseTime)
+		}
+	}
+
+	age, err := rfc.CorrectedAge(cached.Header, cached.RequestTime, cached.ResponseTime, time.Now())
+	if err != nil {
+		age = time.Since(cached.ResponseTime)
+	}
+
+	freshness, err := rfc.Freshness(rfc.FreshnessInput{
+		MaxAge:              maxAge,
+		Age:                 age,
+		RequestCacheControl: reqCC,
+	})
+	if err != nil {
+		return true
+	}
+
+	needsValidation, err := rfc.NeedsValidation(rfc.NeedsValidationInput{
+		MustValidate:        cc.Has("must-revalidate") || cc.Has("no-cache"),
+		Freshness:           freshness,
+		RequestCacheControl: reqCC,
+	})
+	if err != nil {
+		return true
+	}
+
+	return needsValidation
+}
+
+func (t *Transport) maybeStore(key string, req *http.Request, resp *http.Response) {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		resp.Body = io.NopCloser(bytes.NewReader(nil))
+		return
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	now := time.Now()
+	cc := rfc.ParseCacheControl(resp.Header.Get("Cache-Control"))
+
+	_, hasExplicitExpiration := cc.Get("max-age")
+	if !hasExplicitExpiration {
+		_, hasExplicitExpiration = cc.Get("s-maxage")
+	}
+	if !hasExplicitExpiration {
+		_, hasExplicitExpiration = resp.Header["Expires"]
+	}
+
+	if !rfc.IsCacheable(rfc.IsCacheableInput{
+		Status:                resp.StatusCode,
+		ResponseCacheControl:  cc,
+		RequestHasAuth:        req.Header.Get("Authorization") != "",
+		ResponseHasAuth:       resp.Header.Get("Authorization") != "",
+		Shared:                t.Shared,
+		HasExplicitExpiration: hasExplicitExpiration,
+		HasValidators:         resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "",
+	}) {
+		return
+	}
+
+	t.Store.Set(key, &CachedResponse{
+		StatusCode:    resp.StatusCode,
+		Header:        resp.Header.Clone(),
+		Body:          body,
+		RequestHeader: req.Header.Clone(),
+		RequestTime:   now,
+		ResponseTime:  now,
+	})
+}
+
+func (c *CachedResponse) toResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		StatusCode:    c.StatusCode,
+		Status:        http.StatusText(c.StatusCode),
+		Header:        c.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+	}
+}
+
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	cc := rfc.ParseCacheControl(req.Header.Get("Cache-Control"))
+	return !cc.Has("no-store") && !cc.Has("no-cache")
+}
+
+func cacheKey(req *http.Request) string {
+	return req.Method + ":" + req.URL.String()
+}
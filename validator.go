@@ -0,0 +1,68 @@
+package httpcache
+
+import "net/http"
+
+// Validator revalidates a stale cached Resource against the upstream
+// handler. It prefers a conditional request (If-None-Match /
+// If-Modified-Since, built from the cached resource's own validators) over
+// a full refetch, per RFC 7232.
+type Validator struct {
+	upstream http.Handler
+}
+
+// Validate issues a conditional request upstream for res. A 304 response
+// confirms res is still current: its headers are merged into res per RFC
+// 7232 section 4.1 and Validate returns (true, nil). Any other response
+// means res is stale, and since the conditional request already fetched the
+// replacement in full, Validate returns (false, replacement) instead of
+// making the caller issue a second, non-conditional request just to get the
+// same thing. The caller owns replacement and must Close it.
+func (v *Validator) Validate(r *http.Request, res *Resource) (bool, *Resource) {
+	req := conditionalRequest(r, res)
+
+	rw := newResponseBuffer(newDiscardResponseWriter())
+	v.upstream.ServeHTTP(rw, req)
+	updated := rw.Resource()
+
+	if updated.Status() != http.StatusNotModified {
+		debugf("validation request for %s returned %d, resource has changed", r.URL.String(), updated.Status())
+		return false, updated
+	}
+
+	debugf("validation request for %s returned 304, resource is still current", r.URL.String())
+	mergeValidatorHeaders(res.Header(), updated.Header())
+	updated.Close()
+	return true, nil
+}
+
+// conditionalRequest returns a copy of r decorated with If-None-Match and
+// If-Modified-Since built from res's own ETag/Last-Modified, replacing any
+// conditional headers the original client request may have carried.
+func conditionalRequest(r *http.Request, res *Resource) *http.Request {
+	req := r.Clone(r.Context())
+	req.Header = r.Header.Clone()
+
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	req.Header.Del("If-Match")
+	req.Header.Del("If-Unmodified-Since")
+	req.Header.Del("If-Range")
+
+	if etag := res.Header().Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := res.Header().Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	return req
+}
+
+// mergeValidatorHeaders copies every header from a 304 response into the
+// cached response's headers: per RFC 7232 section 4.1 a 304 updates the
+// stored representation's metadata rather than replacing it outright.
+func mergeValidatorHeaders(cached, fresh http.Header) {
+	for name, values := range fresh {
+		cached[name] = values
+	}
+}